@@ -0,0 +1,218 @@
+// Copyright 2018-2020 Petr Homola. All rights reserved.
+// Use of this source code is governed by the AGPL v3.0
+// that can be found in the LICENSE file.
+
+package lrparser
+
+import (
+	"fmt"
+
+	"github.com/phomola/textkit"
+)
+
+// gssNode is one node of the graph-structured stack (GSS): a parser
+// state shared by every active fork whose stack top is currently in
+// that state. Its back-edges record how it was reached - there's one
+// edge per distinct (predecessor node, shifted/reduced value) pair, so
+// a node that several forks converge on on keeps all of their histories
+// instead of picking one, and a node several forks diverge from after
+// an ambiguous reduction keeps one edge per derivation.
+type gssNode struct {
+	state string
+	out   []*gssEdge
+}
+
+// gssEdge is a stack link from a node back to the predecessor it was
+// pushed onto, carrying the semantic value (a token for a shift, or a
+// Rule.Conv result for a reduction's goto) that labels the link.
+type gssEdge struct {
+	to    *gssNode
+	value interface{}
+}
+
+func newGSSNode(state string) *gssNode { return &gssNode{state: state} }
+
+// pathsOfLength returns every sequence of n edges reachable by walking
+// backwards from node, one sequence per distinct stack history of that
+// length. Each returned path is ordered nearest-edge-first (path[0] is
+// the most recently pushed symbol); this is how a reduction by an
+// n-symbol rule "traverses all paths of the required length" through
+// the shared stack instead of assuming a single linear history.
+func pathsOfLength(node *gssNode, n int) [][]*gssEdge {
+	if n == 0 {
+		return [][]*gssEdge{nil}
+	}
+	var out [][]*gssEdge
+	for _, e := range node.out {
+		for _, rest := range pathsOfLength(e.to, n-1) {
+			out = append(out, append([]*gssEdge{e}, rest...))
+		}
+	}
+	return out
+}
+
+// reduceKey identifies one (node, rule, path) combination so the reduce
+// worklist below never replays the same derivation twice, even though a
+// node can be re-queued whenever a new edge into it might complete a
+// fresh path.
+func reduceKey(n *gssNode, ruleIdx int, path []*gssEdge) string {
+	key := fmt.Sprintf("%d@%p", ruleIdx, n)
+	for _, e := range path {
+		key += fmt.Sprintf(">%p", e)
+	}
+	return key
+}
+
+// conflictAlternatives returns, for every (state, terminal) pair with a
+// recorded conflict, the actions that lost to the one already installed
+// in actionTable - the extra choices ParseGLR forks on.
+func (gr *Grammar) conflictAlternatives() map[tableKey][]action {
+	alts := make(map[tableKey][]action, len(gr.conflicts))
+	for _, c := range gr.conflicts {
+		key := tableKey{c.State, c.Lookahead}
+		switch c.Type {
+		case ShiftReduceConflict:
+			alts[key] = append(alts[key], &reduceAction{c.Rule})
+		case ReduceReduceConflict:
+			alts[key] = append(alts[key], &reduceAction{c.OtherRule})
+		}
+	}
+	return alts
+}
+
+// actionsAt returns every action applicable in state on terminal,
+// including ones a plain LALR(1) table would have discarded to a
+// conflict.
+func (gr *Grammar) actionsAt(alts map[tableKey][]action, state, terminal string) []action {
+	key := tableKey{state, terminal}
+	var actions []action
+	if a, ok := gr.actionTable[key]; ok {
+		actions = append(actions, a)
+	}
+	actions = append(actions, alts[key]...)
+	return actions
+}
+
+// reduceToFixpoint runs every applicable reduction on terminal against
+// frontier (a state -> node map of the current stack tops), adding
+// newly reachable nodes to frontier as it goes, until no node yields a
+// reduction that hasn't already been performed. Because frontier merges
+// nodes by state, two forks that happen to land on the same state share
+// the rest of the worklist instead of each re-deriving it.
+func (gr *Grammar) reduceToFixpoint(alts map[tableKey][]action, frontier map[string]*gssNode, terminal string) {
+	queue := make([]*gssNode, 0, len(frontier))
+	for _, n := range frontier {
+		queue = append(queue, n)
+	}
+	seen := make(map[string]bool)
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for _, act := range gr.actionsAt(alts, n.state, terminal) {
+			red, ok := act.(*reduceAction)
+			if !ok {
+				continue
+			}
+			rule := gr.Rules[red.rule]
+			nrhs := len(rule.RHS)
+			for _, path := range pathsOfLength(n, nrhs) {
+				key := reduceKey(n, red.rule, path)
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+
+				base := n
+				if nrhs > 0 {
+					base = path[nrhs-1].to
+				}
+				values := make([]interface{}, nrhs)
+				for i, e := range path {
+					values[nrhs-1-i] = e.value
+				}
+				result := rule.Conv(values)
+				applyLocation(result, values)
+
+				gotoAct, ok := gr.gotoTable[tableKey{base.state, rule.LHS}].(*gotoAction)
+				if !ok {
+					continue
+				}
+				target, ok := frontier[gotoAct.state]
+				if !ok {
+					target = newGSSNode(gotoAct.state)
+					frontier[gotoAct.state] = target
+				}
+				target.out = append(target.out, &gssEdge{to: base, value: result})
+				queue = append(queue, target)
+			}
+		}
+	}
+}
+
+// ParseGLR parses tokens with a GLR parser built on a graph-structured
+// stack (GSS): whenever a state has more than one applicable action on
+// the current lookahead, the parse forks instead of picking (as Parse
+// does) the action BuildItems resolved the conflict to. Forks that land
+// on the same state at the same input position share that state's node
+// and its future - only the derivations that actually diverge keep
+// separate edges - which keeps live node count polynomial in input
+// length even under heavy local ambiguity (the Tomita algorithm's
+// guarantee), unlike forking by copying the whole stack per alternative.
+// Every accepted derivation runs its rules' Conv builders independently,
+// and ParseGLR returns every top-level result it found - more than one
+// if the grammar is genuinely ambiguous on this input.
+func (gr *Grammar) ParseGLR(tokens []*textkit.Token) ([]interface{}, error) {
+	keywords := make(map[string]struct{})
+	for key := range gr.actionTable {
+		if key.column[0] == '&' {
+			keywords[key.column[1:]] = struct{}{}
+		}
+	}
+	alts := gr.conflictAlternatives()
+
+	frontier := map[string]*gssNode{gr.initialState: newGSSNode(gr.initialState)}
+	var accepted []interface{}
+
+	for {
+		token := tokens[0]
+		symb := symbolFor(token, keywords)
+
+		gr.reduceToFixpoint(alts, frontier, symb)
+
+		nextFrontier := make(map[string]*gssNode)
+		for _, n := range frontier {
+			for _, act := range gr.actionsAt(alts, n.state, symb) {
+				switch act := act.(type) {
+				case *shiftAction:
+					target, ok := nextFrontier[act.state]
+					if !ok {
+						target = newGSSNode(act.state)
+						nextFrontier[act.state] = target
+					}
+					target.out = append(target.out, &gssEdge{to: n, value: token})
+				case *acceptAction:
+					for _, e := range n.out {
+						accepted = append(accepted, e.value)
+					}
+				}
+			}
+		}
+
+		if token.Type == textkit.EOF {
+			break
+		}
+		if len(nextFrontier) == 0 {
+			if len(accepted) > 0 {
+				break
+			}
+			return nil, fmt.Errorf("no viable parse at line %s", token.Loc)
+		}
+		frontier = nextFrontier
+		tokens = tokens[1:]
+	}
+
+	if len(accepted) == 0 {
+		return nil, fmt.Errorf("no viable parse at line %s", tokens[0].Loc)
+	}
+	return accepted, nil
+}
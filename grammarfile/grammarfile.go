@@ -0,0 +1,191 @@
+// Copyright 2018-2020 Petr Homola. All rights reserved.
+// Use of this source code is governed by the AGPL v3.0
+// that can be found in the LICENSE file.
+
+// Package grammarfile loads an lrparser.Grammar from a small yacc/menhir-
+// inspired textual DSL, so grammars can live in their own files instead of
+// being hand-assembled from Go closures.
+//
+// A grammar file has an optional header of %token, %left, %right,
+// %nonassoc and %start declarations, a "%%" separator, and then rules of
+// the form:
+//
+//	Name : A B C { addExpr } | D ;
+//
+// Bare identifiers in a rule's RHS are nonterminals unless they were
+// declared with %token or named in a %left, %right or %nonassoc
+// declaration, in which case (like quoted literals and the
+// built-in NUM/STR/ID/EOF/EOL token names) they're terminals. The
+// reserved identifier `error` is always lrparser's error pseudo-terminal.
+// The `{ name }` after an alternative names the semantic action that
+// will build its result; register it with BindAction before Build.
+// Alternatives without a `{ name }` default to returning their single
+// RHS value, or the raw argument slice for longer RHSs.
+package grammarfile
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/phomola/lrparser"
+)
+
+// builtinTokens maps the DSL's built-in lexical category names to the
+// terminal symbols lrparser.Parse produces for them.
+var builtinTokens = map[string]string{
+	"NUM": "_NUM",
+	"STR": "_STR",
+	"ID":  "_ID",
+	"EOF": "_EOF",
+	"EOL": "_EOL",
+}
+
+// alt is one alternative of a rule, as parsed from the DSL. rhs holds
+// lrparser's resolved symbols (used to build the Rule); rhsSrc holds the
+// same symbols spelled as they appeared in the source, for WriteTo.
+type alt struct {
+	rhs    []string
+	rhsSrc []string
+	action string
+}
+
+// decl is one parsed rule (a LHS and its alternatives), kept around so
+// WriteTo can reproduce the source text.
+type decl struct {
+	lhs  string
+	alts []alt
+}
+
+// Grammar wraps an *lrparser.Grammar parsed from a grammar file. Call
+// BindAction for every named action, then Build to finish constructing
+// the automaton.
+type Grammar struct {
+	*lrparser.Grammar
+	tokens      []string   // raw %token entries, in file order, for WriteTo
+	precSrc     [][]string // source spelling of each Grammar.Precedence level's terminals, for WriteTo
+	start       string
+	decls       []decl
+	customToken map[string]bool
+	actions     map[string][]*lrparser.Rule
+}
+
+// Load parses src in the grammarfile DSL and returns the resulting
+// Grammar, with every rule's Conv already set to its default action; use
+// BindAction to override the ones declared with `{ name }`.
+func Load(src string) (*Grammar, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	g := &Grammar{
+		Grammar:     &lrparser.Grammar{},
+		customToken: map[string]bool{},
+		actions:     map[string][]*lrparser.Rule{},
+	}
+	p := &parser{toks: toks, g: g}
+	if err := p.parseHeader(); err != nil {
+		return nil, err
+	}
+	if err := p.parseRules(); err != nil {
+		return nil, err
+	}
+	if g.start == "" {
+		if len(g.decls) == 0 {
+			return nil, fmt.Errorf("grammarfile: no rules declared")
+		}
+		g.start = g.decls[0].lhs
+	}
+	g.Grammar.Rules = append(g.Grammar.Rules, &lrparser.Rule{
+		LHS: "$start",
+		RHS: []string{g.start},
+		Conv: func(args []interface{}) interface{} {
+			return args[0]
+		},
+	})
+	for _, d := range g.decls {
+		for _, a := range d.alts {
+			rhsLen := len(a.rhs)
+			rule := &lrparser.Rule{LHS: d.lhs, RHS: a.rhs}
+			if a.action != "" {
+				rule.Conv = func([]interface{}) interface{} { return nil }
+				g.actions[a.action] = append(g.actions[a.action], rule)
+			} else {
+				rule.Conv = func(args []interface{}) interface{} {
+					if rhsLen == 1 {
+						return args[0]
+					}
+					return args
+				}
+			}
+			g.Grammar.Rules = append(g.Grammar.Rules, rule)
+		}
+	}
+	return g, nil
+}
+
+// BindAction registers fn as the semantic action for every alternative
+// that was declared with `{ name }` in the DSL.
+func (g *Grammar) BindAction(name string, fn func([]interface{}) interface{}) {
+	for _, r := range g.actions[name] {
+		r.Conv = fn
+	}
+	delete(g.actions, name)
+}
+
+// Build finishes constructing the grammar's LALR(1) automaton. It fails
+// if a `{ name }` action from the DSL was never bound.
+func (g *Grammar) Build() error {
+	if len(g.actions) > 0 {
+		var names []string
+		for name := range g.actions {
+			names = append(names, name)
+		}
+		return fmt.Errorf("grammarfile: unbound actions: %s", strings.Join(names, ", "))
+	}
+	g.Grammar.BuildItems()
+	return nil
+}
+
+// WriteTo serialises the grammar back into the DSL Load accepts.
+func (g *Grammar) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	if len(g.tokens) > 0 {
+		fmt.Fprintf(&b, "%%token %s\n", strings.Join(g.tokens, " "))
+	}
+	for i, level := range g.Grammar.Precedence {
+		var dir string
+		switch level.Assoc {
+		case lrparser.LeftAssoc:
+			dir = "left"
+		case lrparser.RightAssoc:
+			dir = "right"
+		default:
+			dir = "nonassoc"
+		}
+		fmt.Fprintf(&b, "%%%s %s\n", dir, strings.Join(g.precSrc[i], " "))
+	}
+	if g.start != "" {
+		fmt.Fprintf(&b, "%%start %s\n", g.start)
+	}
+	b.WriteString("%%\n")
+	for _, d := range g.decls {
+		b.WriteString(d.lhs)
+		for i, a := range d.alts {
+			if i == 0 {
+				b.WriteString(" :")
+			} else {
+				b.WriteString("\n  |")
+			}
+			for _, s := range a.rhsSrc {
+				b.WriteString(" " + s)
+			}
+			if a.action != "" {
+				fmt.Fprintf(&b, " { %s }", a.action)
+			}
+		}
+		b.WriteString(" ;\n")
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
@@ -0,0 +1,52 @@
+// Copyright 2018-2020 Petr Homola. All rights reserved.
+// Use of this source code is governed by the AGPL v3.0
+// that can be found in the LICENSE file.
+
+package grammarfile
+
+import (
+	"bytes"
+	"testing"
+)
+
+const testGrammar = `%token PLUS
+%left PLUS
+%start E
+
+%%
+E : E PLUS E { add }
+  | NUM ;
+`
+
+// TestLoadAndWriteToRoundTrip checks that a grammar file loaded with
+// Load can be serialised back out with WriteTo and reloaded, which
+// requires WriteTo to reproduce DSL source spelling rather than
+// lrparser's internal symbols.
+func TestLoadAndWriteToRoundTrip(t *testing.T) {
+	g, err := Load(testGrammar)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	g.BindAction("add", func(args []interface{}) interface{} {
+		return args[0].(int) + args[2].(int)
+	})
+	if err := g.Build(); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := g.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+
+	g2, err := Load(buf.String())
+	if err != nil {
+		t.Fatalf("reloading WriteTo's output: %v\n--- output ---\n%s", err, buf.String())
+	}
+	if g2.start != "E" {
+		t.Fatalf("expected %%start to round-trip, got %q", g2.start)
+	}
+	if len(g2.Grammar.Precedence) != 1 {
+		t.Fatalf("expected the %%left declaration to round-trip, got %v", g2.Grammar.Precedence)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2018-2020 Petr Homola. All rights reserved.
+// Use of this source code is governed by the AGPL v3.0
+// that can be found in the LICENSE file.
+
+package grammarfile
+
+import (
+	"fmt"
+
+	"github.com/phomola/lrparser"
+)
+
+type tokKind int
+
+const (
+	tIdent tokKind = iota
+	tString
+	tDirective // a %word, with val holding word without the leading %
+	tPercentPercent
+	tColon
+	tPipe
+	tSemi
+	tLBrace
+	tRBrace
+	tEOF
+)
+
+type tok struct {
+	kind tokKind
+	val  string
+}
+
+func isIdentRune(c rune) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// lex tokenises a grammar file's source text.
+func lex(src string) ([]tok, error) {
+	r := []rune(src)
+	var toks []tok
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case c == '#':
+			for i < len(r) && r[i] != '\n' {
+				i++
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(r) && r[j] != '"' {
+				j++
+			}
+			if j >= len(r) {
+				return nil, fmt.Errorf("grammarfile: unterminated string literal")
+			}
+			toks = append(toks, tok{tString, string(r[i+1 : j])})
+			i = j + 1
+		case c == '%':
+			if i+1 < len(r) && r[i+1] == '%' {
+				toks = append(toks, tok{tPercentPercent, "%%"})
+				i += 2
+				continue
+			}
+			j := i + 1
+			for j < len(r) && isIdentRune(r[j]) {
+				j++
+			}
+			toks = append(toks, tok{tDirective, string(r[i+1 : j])})
+			i = j
+		case c == ':':
+			toks = append(toks, tok{tColon, ":"})
+			i++
+		case c == '|':
+			toks = append(toks, tok{tPipe, "|"})
+			i++
+		case c == ';':
+			toks = append(toks, tok{tSemi, ";"})
+			i++
+		case c == '{':
+			toks = append(toks, tok{tLBrace, "{"})
+			i++
+		case c == '}':
+			toks = append(toks, tok{tRBrace, "}"})
+			i++
+		case isIdentRune(c):
+			j := i
+			for j < len(r) && isIdentRune(r[j]) {
+				j++
+			}
+			toks = append(toks, tok{tIdent, string(r[i:j])})
+			i = j
+		default:
+			return nil, fmt.Errorf("grammarfile: unexpected character %q", c)
+		}
+	}
+	return append(toks, tok{tEOF, ""}), nil
+}
+
+// parser turns a token stream into decls on g.
+type parser struct {
+	toks []tok
+	pos  int
+	g    *Grammar
+}
+
+func (p *parser) peek() tok { return p.toks[p.pos] }
+
+func (p *parser) next() tok {
+	t := p.toks[p.pos]
+	if p.pos+1 < len(p.toks) {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(k tokKind, what string) (tok, error) {
+	if p.peek().kind != k {
+		return tok{}, fmt.Errorf("grammarfile: expected %s, got %q", what, p.peek().val)
+	}
+	return p.next(), nil
+}
+
+// tokenSymbol resolves a %token/%left/%right/%nonassoc entry to its
+// lrparser terminal symbol, registering bare identifiers as custom
+// tokens along the way (yacc-style implicit declaration).
+func (p *parser) tokenSymbol(t tok) string {
+	if t.kind == tString {
+		return "&" + t.val
+	}
+	if t.val == "error" {
+		return "error"
+	}
+	if sym, ok := builtinTokens[t.val]; ok {
+		return sym
+	}
+	p.g.customToken[t.val] = true
+	return "&" + t.val
+}
+
+// rhsSymbol resolves a rule-body symbol: a terminal if it's `error`,
+// quoted, built-in, or a previously declared custom token, otherwise a
+// bare nonterminal name.
+func (p *parser) rhsSymbol(t tok) string {
+	if t.kind == tString {
+		return "&" + t.val
+	}
+	if t.val == "error" {
+		return "error"
+	}
+	if sym, ok := builtinTokens[t.val]; ok {
+		return sym
+	}
+	if p.g.customToken[t.val] {
+		return "&" + t.val
+	}
+	return t.val
+}
+
+// tokenSource returns t exactly as it would be spelled in the DSL
+// source, for use by WriteTo; unlike tokenSymbol/rhsSymbol it never
+// translates into lrparser's internal symbol form.
+func tokenSource(t tok) string {
+	if t.kind == tString {
+		return "\"" + t.val + "\""
+	}
+	return t.val
+}
+
+func (p *parser) parseHeader() error {
+	for p.peek().kind == tDirective {
+		dir := p.next().val
+		switch dir {
+		case "token":
+			for p.peek().kind == tIdent || p.peek().kind == tString {
+				t := p.next()
+				p.tokenSymbol(t) // registers custom tokens
+				if t.kind == tString {
+					p.g.tokens = append(p.g.tokens, "\""+t.val+"\"")
+				} else {
+					p.g.tokens = append(p.g.tokens, t.val)
+				}
+			}
+		case "left", "right", "nonassoc":
+			assoc := lrparser.LeftAssoc
+			switch dir {
+			case "right":
+				assoc = lrparser.RightAssoc
+			case "nonassoc":
+				assoc = lrparser.NonAssoc
+			}
+			var terminals, src []string
+			for p.peek().kind == tIdent || p.peek().kind == tString {
+				t := p.next()
+				terminals = append(terminals, p.tokenSymbol(t))
+				src = append(src, tokenSource(t))
+			}
+			p.g.Grammar.Precedence = append(p.g.Grammar.Precedence, lrparser.PrecLevel{Assoc: assoc, Terminals: terminals})
+			p.g.precSrc = append(p.g.precSrc, src)
+		case "start":
+			name, err := p.expect(tIdent, "a nonterminal name after %start")
+			if err != nil {
+				return err
+			}
+			p.g.start = name.val
+		default:
+			return fmt.Errorf("grammarfile: unknown directive %%%s", dir)
+		}
+	}
+	_, err := p.expect(tPercentPercent, "%%")
+	return err
+}
+
+func (p *parser) parseRules() error {
+	for p.peek().kind != tEOF && p.peek().kind != tPercentPercent {
+		lhs, err := p.expect(tIdent, "a rule name")
+		if err != nil {
+			return err
+		}
+		if _, err := p.expect(tColon, "':'"); err != nil {
+			return err
+		}
+		var alts []alt
+		for {
+			var rhs, rhsSrc []string
+			for p.peek().kind == tIdent || p.peek().kind == tString {
+				t := p.next()
+				rhs = append(rhs, p.rhsSymbol(t))
+				rhsSrc = append(rhsSrc, tokenSource(t))
+			}
+			action := ""
+			if p.peek().kind == tLBrace {
+				p.next()
+				name, err := p.expect(tIdent, "an action name")
+				if err != nil {
+					return err
+				}
+				action = name.val
+				if _, err := p.expect(tRBrace, "'}'"); err != nil {
+					return err
+				}
+			}
+			alts = append(alts, alt{rhs, rhsSrc, action})
+			if p.peek().kind == tPipe {
+				p.next()
+				continue
+			}
+			break
+		}
+		if _, err := p.expect(tSemi, "';'"); err != nil {
+			return err
+		}
+		p.g.decls = append(p.g.decls, decl{lhs.val, alts})
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+// Copyright 2018-2020 Petr Homola. All rights reserved.
+// Use of this source code is governed by the AGPL v3.0
+// that can be found in the LICENSE file.
+
+package lrparser
+
+import "github.com/phomola/textkit"
+
+type incStatus int
+
+const (
+	incNeedMore incStatus = iota
+	incAccepted
+	incError
+)
+
+// runIncremental drives the shift/reduce loop over *tokens, mutating
+// *stateStack and *resultStack in place, until either the tokens run
+// out (incNeedMore), an action reduces all the way to accept
+// (incAccepted), or no action applies (incError). Unlike Parse, it
+// never consults an ErrorHandler: an IncrementalParser surfaces a
+// syntax error directly instead of recovering from it, since there's
+// no way to know in advance whether more input is coming.
+func (gr *Grammar) runIncremental(stateStack *[]string, resultStack *[]interface{}, tokens *[]*textkit.Token, keywords map[string]struct{}, terminals map[string]struct{}) (incStatus, interface{}, *ParseError) {
+	for {
+		if len(*tokens) == 0 {
+			return incNeedMore, nil, nil
+		}
+		token := (*tokens)[0]
+		symb := symbolFor(token, keywords)
+		state := (*stateStack)[len(*stateStack)-1]
+		act := gr.actionTable[tableKey{state, symb}]
+		switch act := act.(type) {
+		case *shiftAction:
+			*resultStack = append(*resultStack, token)
+			*stateStack = append(*stateStack, act.state)
+			*tokens = (*tokens)[1:]
+		case *reduceAction:
+			rule := gr.Rules[act.rule]
+			results := (*resultStack)[len(*resultStack)-len(rule.RHS):]
+			*resultStack = (*resultStack)[: len(*resultStack)-len(rule.RHS) : len(*resultStack)-len(rule.RHS)]
+			*stateStack = (*stateStack)[:len(*stateStack)-len(rule.RHS)]
+			r := rule.Conv(results)
+			applyLocation(r, results)
+			*resultStack = append(*resultStack, r)
+			next, ok := gr.gotoTable[tableKey{(*stateStack)[len(*stateStack)-1], rule.LHS}]
+			if !ok {
+				return incError, nil, &ParseError{State: (*stateStack)[len(*stateStack)-1], Token: token}
+			}
+			*stateStack = append(*stateStack, next.(*gotoAction).state)
+		case *acceptAction:
+			return incAccepted, (*resultStack)[0], nil
+		default:
+			return incError, nil, &ParseError{State: state, Token: token, Expected: gr.expectedSymbols(state, terminals)}
+		}
+	}
+}
+
+// IncrementalParser is a Grammar parse that's fed tokens piecewise
+// instead of all at once, for a REPL reading line by line or an editor
+// re-parsing only the part of the buffer that changed. It holds no
+// ErrorHandler-style recovery: once Feed reports an error, later calls
+// to Feed and Finish return that same error (and NeedsMore reports
+// false) until Restore rewinds to a checkpoint.
+type IncrementalParser struct {
+	gr          *Grammar
+	keywords    map[string]struct{}
+	terminals   map[string]struct{}
+	stateStack  []string
+	resultStack []interface{}
+	err         error
+}
+
+// NewIncremental starts a new incremental parse against gr.
+func (gr *Grammar) NewIncremental() *IncrementalParser {
+	terminals := make(map[string]struct{})
+	keywords := make(map[string]struct{})
+	for key := range gr.actionTable {
+		terminals[key.column] = struct{}{}
+		if key.column[0] == '&' {
+			keywords[key.column[1:]] = struct{}{}
+		}
+	}
+	return &IncrementalParser{
+		gr:         gr,
+		keywords:   keywords,
+		terminals:  terminals,
+		stateStack: []string{gr.initialState},
+	}
+}
+
+// Feed shifts and reduces as much of tokens as the grammar currently
+// allows. It stops (without error) once tokens runs out - that's the
+// normal case for a REPL handing over one line at a time - and reports
+// an error the first time no action applies to the current token.
+func (p *IncrementalParser) Feed(tokens []*textkit.Token) error {
+	if p.err != nil {
+		return p.err
+	}
+	status, _, perr := p.gr.runIncremental(&p.stateStack, &p.resultStack, &tokens, p.keywords, p.terminals)
+	if status == incError {
+		p.err = perr
+		return perr
+	}
+	return nil
+}
+
+// finishOn simulates feeding EOF to a copy of stateStack/resultStack,
+// without touching p, to see whether the parse the tokens fed so far
+// describe is already complete.
+func (p *IncrementalParser) finishOn(stateStack []string, resultStack []interface{}) (interface{}, *ParseError) {
+	tokens := []*textkit.Token{syntheticToken("_EOF", textkit.Location{})}
+	status, result, perr := p.gr.runIncremental(&stateStack, &resultStack, &tokens, p.keywords, p.terminals)
+	if status == incAccepted {
+		return result, nil
+	}
+	return nil, perr
+}
+
+// NeedsMore reports whether the tokens fed so far form an unfinished
+// but still legal prefix: the grammar wouldn't accept them as-is (EOF
+// right now would be a syntax error), yet some other terminal has a
+// legal shift or reduce from the current state. A REPL calls this after
+// Feed returns nil to decide whether to read another line or, if it
+// returns false, call Finish to get the result (or the error).
+func (p *IncrementalParser) NeedsMore() bool {
+	if p.err != nil {
+		return false
+	}
+	stateStack := append([]string(nil), p.stateStack...)
+	resultStack := append([]interface{}(nil), p.resultStack...)
+	if _, perr := p.finishOn(stateStack, resultStack); perr == nil {
+		return false
+	}
+	state := p.stateStack[len(p.stateStack)-1]
+	for terminal := range p.terminals {
+		if terminal == "_EOF" {
+			continue
+		}
+		if _, ok := p.gr.actionTable[tableKey{state, terminal}]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Finish feeds EOF to the tokens accumulated so far and returns the
+// completed parse. It doesn't consume the parser: on error, p keeps
+// whatever state it had before the call, so the caller can inspect
+// NeedsMore, roll back with Restore, or just keep calling Feed.
+func (p *IncrementalParser) Finish() (interface{}, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	stateStack := append([]string(nil), p.stateStack...)
+	resultStack := append([]interface{}(nil), p.resultStack...)
+	result, perr := p.finishOn(stateStack, resultStack)
+	if perr != nil {
+		return nil, perr
+	}
+	return result, nil
+}
+
+// Checkpoint is a cheap snapshot of an IncrementalParser's state and
+// result stacks, returned by IncrementalParser.Checkpoint and consumed
+// by Restore. It only copies the (small) stacks, not the tokens that
+// produced them, so taking one costs O(stack depth), not O(input fed
+// so far) - cheap enough for an editor to checkpoint after every
+// accepted statement and rewind there on an edit instead of re-parsing
+// the whole buffer.
+type Checkpoint struct {
+	stateStack  []string
+	resultStack []interface{}
+}
+
+// Checkpoint snapshots p's current stacks.
+func (p *IncrementalParser) Checkpoint() *Checkpoint {
+	return &Checkpoint{
+		stateStack:  append([]string(nil), p.stateStack...),
+		resultStack: append([]interface{}(nil), p.resultStack...),
+	}
+}
+
+// Restore rewinds p to a previously taken Checkpoint, discarding
+// whatever tokens were fed (and any error raised) since then.
+func (p *IncrementalParser) Restore(cp *Checkpoint) {
+	p.stateStack = append([]string(nil), cp.stateStack...)
+	p.resultStack = append([]interface{}(nil), cp.resultStack...)
+	p.err = nil
+}
@@ -18,6 +18,11 @@ type Rule struct {
 	LHS  string
 	RHS  []string
 	Conv func([]interface{}) interface{}
+	// Prec optionally names a terminal declared in Grammar.Precedence
+	// whose precedence/associativity this rule should use for
+	// shift/reduce resolution (yacc's %prec), overriding the default of
+	// the rule's rightmost terminal.
+	Prec string
 }
 
 // String returns a string representation of the rule.
@@ -25,11 +30,16 @@ func (r *Rule) String() string {
 	return fmt.Sprintf("%s -> %v", r.LHS, r.RHS)
 }
 
-// Item is an item of the parser.
+// Item is an item of the parser. RuleIdx identifies which rule in
+// Grammar.Rules the item was derived from, and LA holds the set of
+// terminals under which a completed item (DotPos == len(RHS)) may be
+// reduced.
 type Item struct {
-	LHS    string
-	RHS    []string
-	DotPos int
+	LHS     string
+	RHS     []string
+	DotPos  int
+	RuleIdx int
+	LA      map[string]struct{}
 }
 
 func (it *Item) String() string {
@@ -47,6 +57,35 @@ func (it *Item) String() string {
 	return s + ";"
 }
 
+func cloneLA(la map[string]struct{}) map[string]struct{} {
+	la2 := make(map[string]struct{}, len(la))
+	for t := range la {
+		la2[t] = struct{}{}
+	}
+	return la2
+}
+
+// mergeLA unions src into dst and reports whether dst changed.
+func mergeLA(dst, src map[string]struct{}) bool {
+	changed := false
+	for t := range src {
+		if _, ok := dst[t]; !ok {
+			dst[t] = struct{}{}
+			changed = true
+		}
+	}
+	return changed
+}
+
+func sortedLA(la map[string]struct{}) []string {
+	terminals := make([]string, 0, len(la))
+	for t := range la {
+		terminals = append(terminals, t)
+	}
+	sort.Strings(terminals)
+	return terminals
+}
+
 // State is a state of the parser.
 type State struct {
 	Items []*Item
@@ -81,89 +120,478 @@ type gotoAction struct {
 	state string
 }
 
+// ConflictType identifies the kind of LALR(1) conflict that was found
+// while building the action table.
+type ConflictType int
+
+// constants for ConflictType
+const (
+	ShiftReduceConflict ConflictType = iota
+	ReduceReduceConflict
+)
+
+func (t ConflictType) String() string {
+	if t == ShiftReduceConflict {
+		return "shift/reduce"
+	}
+	return "reduce/reduce"
+}
+
+// Conflict describes a shift/reduce or reduce/reduce conflict found while
+// building the action table, along with enough information for a caller
+// to resolve it (e.g. via BuildOperatorRules or hand-written precedence
+// rules) instead of relying on the default resolution.
+type Conflict struct {
+	Type      ConflictType
+	State     string // signature of the state the conflict occurs in
+	Lookahead string // the terminal the conflict occurs on
+	Rule      int    // the rule whose reduction was kept (or, for shift/reduce, the rule that lost to the shift)
+	OtherRule int    // for reduce/reduce conflicts, the rule that was discarded; unused otherwise
+}
+
+func (c Conflict) String() string {
+	if c.Type == ShiftReduceConflict {
+		return fmt.Sprintf("shift/reduce conflict on %s in state %q (rule %d)", c.Lookahead, c.State, c.Rule)
+	}
+	return fmt.Sprintf("reduce/reduce conflict on %s in state %q (rules %d and %d)", c.Lookahead, c.State, c.Rule, c.OtherRule)
+}
+
 // Located specifies methods for AST node location.
 type Located interface {
 	Location() textkit.Location
 	SetLocation(textkit.Location)
 }
 
+// applyLocation sets r's location, if it implements Located, to that of
+// the first located element among a reduction's RHS results.
+func applyLocation(r interface{}, results []interface{}) {
+	loc, ok := r.(Located)
+	if !ok {
+		return
+	}
+	for _, el := range results {
+		switch x := el.(type) {
+		case *textkit.Token:
+			loc.SetLocation(x.Loc)
+			return
+		case Located:
+			loc.SetLocation(x.Location())
+			return
+		}
+	}
+}
+
+// Associativity describes how operators at the same precedence level
+// associate.
+type Associativity int
+
+// constants for Associativity
+const (
+	LeftAssoc Associativity = iota
+	RightAssoc
+	NonAssoc
+)
+
+// PrecLevel is one %left/%right/%nonassoc declaration. Levels declared
+// later in Grammar.Precedence bind tighter than earlier ones, exactly
+// like yacc's declaration order.
+type PrecLevel struct {
+	Assoc     Associativity
+	Terminals []string
+}
+
+type precInfo struct {
+	level int
+	assoc Associativity
+}
+
 // Grammar is a formal grammar.
 type Grammar struct {
 	// The rules of the grammar.
-	Rules        []*Rule
+	Rules []*Rule
+	// Precedence declares the precedence/associativity of terminals, in
+	// order of increasing priority, for resolving shift/reduce
+	// conflicts (yacc's %left/%right/%nonassoc). A rule uses the
+	// precedence of its Prec tag if set, otherwise that of its
+	// rightmost terminal.
+	Precedence   []PrecLevel
 	states       map[string]*State
 	initialState string
 	actionTable  map[tableKey]action
 	gotoTable    map[tableKey]action
+	conflicts    []Conflict
+	precTable    map[string]precInfo
+	// ErrorHandler, if set, is consulted every time Parse hits a token
+	// with no legal action. It decides how to recover; if it's nil,
+	// Parse falls back to panic-mode recovery via the `error`
+	// pseudo-terminal.
+	ErrorHandler func(state string, token *textkit.Token, expected []string) RecoveryAction
+}
+
+// RecoveryActionKind is the kind of recovery ErrorHandler asked for.
+type RecoveryActionKind int
+
+// constants for RecoveryActionKind
+const (
+	RecoverySkip RecoveryActionKind = iota
+	RecoveryInsert
+	RecoveryReplace
+	RecoveryAbort
+)
+
+// RecoveryAction tells Parse how to recover from a syntax error. Build
+// one with Skip, Insert, Replace or Abort.
+type RecoveryAction struct {
+	Kind   RecoveryActionKind
+	Symbol string // the grammar symbol to insert/substitute, for Insert/Replace
+}
+
+// Skip asks Parse to fall back to panic-mode recovery via the `error`
+// pseudo-terminal.
+func Skip() RecoveryAction { return RecoveryAction{Kind: RecoverySkip} }
+
+// Insert asks Parse to pretend symb occurred before the offending token,
+// without consuming it.
+func Insert(symb string) RecoveryAction { return RecoveryAction{Kind: RecoveryInsert, Symbol: symb} }
+
+// Replace asks Parse to pretend the offending token was actually symb.
+func Replace(symb string) RecoveryAction { return RecoveryAction{Kind: RecoveryReplace, Symbol: symb} }
+
+// Abort asks Parse to stop immediately and return the errors collected
+// so far.
+func Abort() RecoveryAction { return RecoveryAction{Kind: RecoveryAbort} }
+
+// ParseError describes a single syntax error encountered during Parse.
+type ParseError struct {
+	State    string // signature of the state the error occurred in
+	Token    *textkit.Token
+	Expected []string // the symbols that would have been legal, if any
+}
+
+func (e *ParseError) Error() string {
+	if len(e.Expected) > 1 {
+		return fmt.Sprintf("expected one of %s at line %s", strings.Join(e.Expected, ", "), e.Token.Loc)
+	} else if len(e.Expected) == 1 {
+		return fmt.Sprintf("expected %s at line %s", e.Expected[0], e.Token.Loc)
+	}
+	return fmt.Sprintf("no expected symbol at line %s", e.Token.Loc)
+}
+
+// ParseErrors collects every syntax error Parse encountered, including
+// the last one if Parse could not recover from it; Parse still
+// returns it as the error value, so callers that only care whether
+// parsing succeeded can keep checking `err != nil`.
+type ParseErrors []*ParseError
+
+func (es ParseErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (gr *Grammar) buildPrecTable() {
+	gr.precTable = make(map[string]precInfo)
+	for level, decl := range gr.Precedence {
+		for _, t := range decl.Terminals {
+			gr.precTable[t] = precInfo{level, decl.Assoc}
+		}
+	}
+}
+
+// rulePrecedence returns the precedence a reduction by rule should use,
+// per Rule.Prec or, failing that, the rule's rightmost terminal.
+func (gr *Grammar) rulePrecedence(rule *Rule) (precInfo, bool) {
+	if rule.Prec != "" {
+		p, ok := gr.precTable[rule.Prec]
+		return p, ok
+	}
+	for i := len(rule.RHS) - 1; i >= 0; i-- {
+		if isTerminal(rule.RHS[i]) {
+			p, ok := gr.precTable[rule.RHS[i]]
+			return p, ok
+		}
+	}
+	return precInfo{}, false
+}
+
+// resolveShiftReduce resolves a shift/reduce conflict on key using the
+// declared precedence of the reducing rule and the shifted terminal.
+// It reports whether precedence information was available to resolve
+// it at all; when either side is undeclared, the caller records a
+// conflict and the existing shift action is left in place.
+func (gr *Grammar) resolveShiftReduce(key tableKey, ruleIdx int, terminal string) bool {
+	rp, ok := gr.rulePrecedence(gr.Rules[ruleIdx])
+	if !ok {
+		return false
+	}
+	tp, ok := gr.precTable[terminal]
+	if !ok {
+		return false
+	}
+	switch {
+	case rp.level > tp.level:
+		gr.actionTable[key] = &reduceAction{ruleIdx}
+	case rp.level < tp.level:
+		// keep the shift
+	default:
+		switch rp.assoc {
+		case LeftAssoc:
+			gr.actionTable[key] = &reduceAction{ruleIdx}
+		case RightAssoc:
+			// keep the shift
+		case NonAssoc:
+			delete(gr.actionTable, key)
+		}
+	}
+	return true
 }
 
-// BuildItems builds the items of the automaton.
+// Conflicts returns the shift/reduce and reduce/reduce conflicts found
+// the last time BuildItems ran. Shift/reduce conflicts default to
+// shifting, and reduce/reduce conflicts default to the earliest-declared
+// rule; a grammar with conflicts is still usable, just ambiguous.
+func (gr *Grammar) Conflicts() []Conflict {
+	return gr.conflicts
+}
+
+// errorSymbol is the reserved pseudo-terminal a rule can use in its RHS
+// to mark an error-recovery point (yacc's `error`).
+const errorSymbol = "error"
+
+func isTerminal(symb string) bool {
+	return symb[0] == '_' || symb[0] == '&' || symb == errorSymbol
+}
+
+// firstSets computes FIRST(X) for every terminal and nonterminal of the
+// grammar, along with whether each nonterminal is nullable (can derive
+// the empty string).
+func (gr *Grammar) firstSets() (map[string]map[string]struct{}, map[string]bool) {
+	first := make(map[string]map[string]struct{})
+	nullable := make(map[string]bool)
+	for _, rule := range gr.Rules {
+		if _, ok := first[rule.LHS]; !ok {
+			first[rule.LHS] = make(map[string]struct{})
+		}
+		if len(rule.RHS) == 0 {
+			nullable[rule.LHS] = true
+		}
+		for _, symb := range rule.RHS {
+			if isTerminal(symb) {
+				if _, ok := first[symb]; !ok {
+					first[symb] = map[string]struct{}{symb: {}}
+				}
+			}
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, rule := range gr.Rules {
+			allNullable := true
+			for _, symb := range rule.RHS {
+				if mergeLA(first[rule.LHS], first[symb]) {
+					changed = true
+				}
+				if !nullable[symb] {
+					allNullable = false
+					break
+				}
+			}
+			if allNullable && !nullable[rule.LHS] {
+				nullable[rule.LHS] = true
+				changed = true
+			}
+		}
+	}
+	return first, nullable
+}
+
+// firstOfSeq returns FIRST(seq); if seq is nullable it also unions in
+// `follow`, the lookahead of whatever seq is followed by.
+func firstOfSeq(seq []string, follow map[string]struct{}, first map[string]map[string]struct{}, nullable map[string]bool) map[string]struct{} {
+	result := make(map[string]struct{})
+	for _, symb := range seq {
+		mergeLA(result, first[symb])
+		if !nullable[symb] {
+			return result
+		}
+	}
+	mergeLA(result, follow)
+	return result
+}
+
+// closeItemsLA computes the closure of a kernel (with lookahead sets
+// already attached) and returns it as a flat, deduplicated slice; items
+// that close over the same core have their lookahead sets merged.
+func (gr *Grammar) closeItemsLA(kernel []*Item, first map[string]map[string]struct{}, nullable map[string]bool) []*Item {
+	closure := make(map[string]*Item, len(kernel))
+	var queue []*Item
+	for _, it := range kernel {
+		key := it.String()
+		if existing, ok := closure[key]; ok {
+			mergeLA(existing.LA, it.LA)
+		} else {
+			it2 := &Item{it.LHS, it.RHS, it.DotPos, it.RuleIdx, cloneLA(it.LA)}
+			closure[key] = it2
+			queue = append(queue, it2)
+		}
+	}
+	for len(queue) > 0 {
+		it := queue[0]
+		queue = queue[1:]
+		if it.DotPos >= len(it.RHS) || isTerminal(it.RHS[it.DotPos]) {
+			continue
+		}
+		symb := it.RHS[it.DotPos]
+		follow := firstOfSeq(it.RHS[it.DotPos+1:], it.LA, first, nullable)
+		for i, rule := range gr.Rules {
+			if rule.LHS != symb {
+				continue
+			}
+			it2 := &Item{rule.LHS, rule.RHS, 0, i, nil}
+			key := it2.String()
+			if existing, ok := closure[key]; ok {
+				if mergeLA(existing.LA, follow) {
+					queue = append(queue, existing)
+				}
+			} else {
+				it2.LA = cloneLA(follow)
+				closure[key] = it2
+				queue = append(queue, it2)
+			}
+		}
+	}
+	items := make([]*Item, 0, len(closure))
+	for _, it := range closure {
+		items = append(items, it)
+	}
+	return items
+}
+
+// BuildItems builds the LALR(1) automaton. It computes the LR(0) item
+// cores as before, but attaches lookahead sets to kernel items by
+// propagating FIRST sets through closure and across gotos until a
+// fixpoint is reached, and only then emits reduce actions - one per
+// terminal in each completed item's lookahead set, rather than under
+// every known terminal. Conflicts are recorded (see Conflicts) instead
+// of panicking: shift wins over reduce, and the earliest-declared rule
+// wins a reduce/reduce tie.
 func (gr *Grammar) BuildItems() {
-	gr.states = make(map[string]*State)
 	gr.actionTable = make(map[tableKey]action)
 	gr.gotoTable = make(map[tableKey]action)
+	gr.conflicts = nil
+	gr.buildPrecTable()
+
+	first, nullable := gr.firstSets()
+
 	rule := gr.Rules[0]
-	acceptingItem := &Item{rule.LHS, rule.RHS, len(rule.RHS)}
-	items := gr.closeItems([]*Item{&Item{rule.LHS, rule.RHS, 0}})
-	state := &State{items}
-	gr.initialState = state.String()
-	states := []*State{state}
-	for len(states) > 0 {
-		state := states[0]
-		states = states[1:]
-		if _, ok := gr.states[state.String()]; !ok {
-			gr.states[state.String()] = state
-			tr := make(map[string]struct{})
-			for _, it := range state.Items {
+	startItem := &Item{rule.LHS, rule.RHS, 0, 0, map[string]struct{}{"_EOF": {}}}
+	acceptingCore := (&Item{rule.LHS, rule.RHS, len(rule.RHS), 0, nil}).String()
+
+	kernels := map[string][]*Item{}
+	var order []string
+	initSig := (&State{[]*Item{startItem}}).String()
+	kernels[initSig] = []*Item{startItem}
+	order = append(order, initSig)
+	gr.initialState = initSig
+
+	for changed := true; changed; {
+		changed = false
+		for i := 0; i < len(order); i++ {
+			sig := order[i]
+			closure := gr.closeItemsLA(kernels[sig], first, nullable)
+
+			grouped := map[string][]*Item{}
+			var symbOrder []string
+			for _, it := range closure {
 				if it.DotPos < len(it.RHS) {
-					tr[it.RHS[it.DotPos]] = struct{}{}
+					symb := it.RHS[it.DotPos]
+					if _, ok := grouped[symb]; !ok {
+						symbOrder = append(symbOrder, symb)
+					}
+					grouped[symb] = append(grouped[symb], it)
 				}
 			}
-			for symb := range tr {
-				var items []*Item
-				for _, it := range state.Items {
-					if it.DotPos < len(it.RHS) && it.RHS[it.DotPos] == symb {
-						items = append(items, &Item{it.LHS, it.RHS, it.DotPos + 1})
-					}
+			for _, symb := range symbOrder {
+				var advanced []*Item
+				for _, it := range grouped[symb] {
+					advanced = append(advanced, &Item{it.LHS, it.RHS, it.DotPos + 1, it.RuleIdx, cloneLA(it.LA)})
 				}
-				items = gr.closeItems(items)
-				state2 := &State{items}
-				if symb[0] == '_' || symb[0] == '&' {
-					gr.actionTable[tableKey{state.String(), symb}] = &shiftAction{state2.String()}
+				targetSig := (&State{advanced}).String()
+
+				if existing, ok := kernels[targetSig]; !ok {
+					merged := map[string]*Item{}
+					var mergedOrder []*Item
+					for _, it := range advanced {
+						key := it.String()
+						if e, ok := merged[key]; ok {
+							mergeLA(e.LA, it.LA)
+						} else {
+							merged[key] = it
+							mergedOrder = append(mergedOrder, it)
+						}
+					}
+					kernels[targetSig] = mergedOrder
+					changed = true
+					order = append(order, targetSig)
 				} else {
-					gr.gotoTable[tableKey{state.String(), symb}] = &gotoAction{state2.String()}
-				}
-				if _, ok := gr.states[state2.String()]; !ok {
-					for _, it := range items {
-						if it.String() == acceptingItem.String() {
-							gr.actionTable[tableKey{state2.String(), "_EOF"}] = &acceptAction{}
+					byKey := make(map[string]*Item, len(existing))
+					for _, it := range existing {
+						byKey[it.String()] = it
+					}
+					for _, it := range advanced {
+						if e, ok := byKey[it.String()]; ok && mergeLA(e.LA, it.LA) {
+							changed = true
 						}
 					}
-					states = append(states, state2)
+				}
+
+				if isTerminal(symb) {
+					gr.actionTable[tableKey{sig, symb}] = &shiftAction{targetSig}
+				} else {
+					gr.gotoTable[tableKey{sig, symb}] = &gotoAction{targetSig}
 				}
 			}
 		}
 	}
-	terminals := make(map[string]struct{})
-	for key := range gr.actionTable {
-		terminals[key.column] = struct{}{}
+
+	gr.states = make(map[string]*State, len(order))
+	for _, sig := range order {
+		closure := gr.closeItemsLA(kernels[sig], first, nullable)
+		gr.states[sig] = &State{closure}
+		for _, it := range closure {
+			if it.String() == acceptingCore {
+				gr.actionTable[tableKey{sig, "_EOF"}] = &acceptAction{}
+			}
+		}
 	}
-	for _, state := range gr.states {
-		for i, rule := range gr.Rules {
-			if i > 0 {
-				it := &Item{rule.LHS, rule.RHS, len(rule.RHS)}
-				for _, it2 := range state.Items {
-					if it.String() == it2.String() {
-						for terminal := range terminals {
-							if prevAction, ok := gr.actionTable[tableKey{state.String(), terminal}]; ok {
-								if _, ok := prevAction.(*shiftAction); !ok {
-									panic(fmt.Sprintf("conflict: %s %T %s", terminal, prevAction, prevAction))
-								}
-							} else {
-								gr.actionTable[tableKey{state.String(), terminal}] = &reduceAction{i}
+
+	for _, sig := range order {
+		for _, it := range gr.states[sig].Items {
+			if it.DotPos != len(it.RHS) || it.RuleIdx == 0 {
+				continue
+			}
+			for _, terminal := range sortedLA(it.LA) {
+				key := tableKey{sig, terminal}
+				if prevAction, ok := gr.actionTable[key]; ok {
+					switch prev := prevAction.(type) {
+					case *shiftAction:
+						if !gr.resolveShiftReduce(key, it.RuleIdx, terminal) {
+							gr.conflicts = append(gr.conflicts, Conflict{Type: ShiftReduceConflict, State: sig, Lookahead: terminal, Rule: it.RuleIdx})
+						}
+					case *reduceAction:
+						if prev.rule != it.RuleIdx {
+							winner, loser := prev.rule, it.RuleIdx
+							if it.RuleIdx < prev.rule {
+								winner, loser = it.RuleIdx, prev.rule
+								prev.rule = it.RuleIdx
 							}
+							gr.conflicts = append(gr.conflicts, Conflict{Type: ReduceReduceConflict, State: sig, Lookahead: terminal, Rule: winner, OtherRule: loser})
 						}
 					}
+				} else {
+					gr.actionTable[key] = &reduceAction{it.RuleIdx}
 				}
 			}
 		}
@@ -171,34 +599,112 @@ func (gr *Grammar) BuildItems() {
 	//fmt.Println("# states:", len(gr.states))
 }
 
-func (gr *Grammar) closeItems(items []*Item) []*Item {
-	m := make(map[string]*Item, len(items))
-	for _, it := range items {
-		m[it.String()] = it
-	}
-	for len(items) > 0 {
-		it := items[0]
-		items = items[1:]
-		if it.DotPos < len(it.RHS) {
-			symb := it.RHS[it.DotPos]
-			for _, rule := range gr.Rules {
-				if rule.LHS == symb {
-					it2 := &Item{rule.LHS, rule.RHS, 0}
-					if _, ok := m[it2.String()]; !ok {
-						m[it2.String()] = it2
-						items = append(items, it2)
-					}
-				}
+// symbolFor maps a token to its grammar symbol.
+func symbolFor(token *textkit.Token, keywords map[string]struct{}) string {
+	switch token.Type {
+	case textkit.Symbol:
+		return "&" + string(token.Form)
+	case textkit.Number:
+		return "_NUM"
+	case textkit.String:
+		return "_STR"
+	case textkit.EOF:
+		return "_EOF"
+	case textkit.EOL:
+		return "_EOL"
+	case textkit.Word:
+		if _, ok := keywords[string(token.Form)]; ok {
+			return "&" + string(token.Form)
+		}
+		return "_ID"
+	}
+	return ""
+}
+
+// syntheticToken builds a token that resolves to symb under symbolFor,
+// for ErrorHandler's Insert/Replace recovery actions.
+func syntheticToken(symb string, loc textkit.Location) *textkit.Token {
+	switch symb {
+	case "_NUM":
+		return &textkit.Token{Type: textkit.Number, Loc: loc}
+	case "_STR":
+		return &textkit.Token{Type: textkit.String, Loc: loc}
+	case "_ID":
+		return &textkit.Token{Type: textkit.Word, Loc: loc}
+	case "_EOF":
+		return &textkit.Token{Type: textkit.EOF, Loc: loc}
+	case "_EOL":
+		return &textkit.Token{Type: textkit.EOL, Loc: loc}
+	default:
+		if len(symb) > 0 && symb[0] == '&' {
+			return &textkit.Token{Type: textkit.Symbol, Form: []rune(symb[1:]), Loc: loc}
+		}
+		return &textkit.Token{Type: textkit.Word, Form: []rune(symb), Loc: loc}
+	}
+}
+
+func (gr *Grammar) expectedSymbols(state string, terminals map[string]struct{}) []string {
+	var expected []string
+	for terminal := range terminals {
+		if _, ok := gr.actionTable[tableKey{state, terminal}]; ok {
+			symbol := terminal
+			if terminal[0] == '&' {
+				symbol = "'" + terminal[1:] + "'"
 			}
+			switch terminal {
+			case "_ID":
+				symbol = "identifier"
+			case "_STR":
+				symbol = "string"
+			case "_NUM":
+				symbol = "number"
+			case "_EOF":
+				symbol = "EOF"
+			case "_EOL":
+				symbol = "EOL"
+			}
+			expected = append(expected, symbol)
 		}
 	}
-	for _, it := range m {
-		items = append(items, it)
+	return expected
+}
+
+// recover performs panic-mode recovery via the `error` pseudo-terminal:
+// it pops states until one can shift `error`, shifts it, then discards
+// input until a token is a legal lookahead in the resulting state. It
+// reports whether a recovery point was found at all.
+func (gr *Grammar) recover(stateStack *[]string, resultStack *[]interface{}, tokens *[]*textkit.Token, keywords map[string]struct{}) bool {
+	for len(*stateStack) > 0 {
+		state := (*stateStack)[len(*stateStack)-1]
+		if act, ok := gr.actionTable[tableKey{state, errorSymbol}].(*shiftAction); ok {
+			*stateStack = append(*stateStack, act.state)
+			*resultStack = append(*resultStack, nil)
+			for {
+				token := (*tokens)[0]
+				if _, ok := gr.actionTable[tableKey{act.state, symbolFor(token, keywords)}]; ok {
+					return true
+				}
+				if token.Type == textkit.EOF {
+					return false
+				}
+				*tokens = (*tokens)[1:]
+			}
+		}
+		*stateStack = (*stateStack)[:len(*stateStack)-1]
+		if len(*resultStack) > 0 {
+			*resultStack = (*resultStack)[:len(*resultStack)-1]
+		}
 	}
-	return items
+	return false
 }
 
-// Parse parses a list of tokens.
+// Parse parses a list of tokens. On a syntax error, Parse consults
+// ErrorHandler (if set) to decide how to recover and keeps going,
+// collecting every error it recovers from into a ParseErrors value
+// returned as the error result; a nil ErrorHandler (or one returning
+// Skip) falls back to panic-mode recovery via the `error`
+// pseudo-terminal. If no recovery point is found, Parse aborts and
+// returns the errors collected so far.
 func (gr *Grammar) Parse(tokens []*textkit.Token) (interface{}, error) {
 	terminals := make(map[string]struct{})
 	for key := range gr.actionTable {
@@ -210,114 +716,60 @@ func (gr *Grammar) Parse(tokens []*textkit.Token) (interface{}, error) {
 			keywords[key.column[1:]] = struct{}{}
 		}
 	}
+	var errs ParseErrors
 	stateStack := []string{gr.initialState}
 	resultStack := []interface{}{}
 	for {
 		token := tokens[0]
-		var symb string
-		switch token.Type {
-		case textkit.Symbol:
-			symb = "&" + string(token.Form)
-		case textkit.Number:
-			symb = "_NUM"
-		case textkit.String:
-			symb = "_STR"
-		case textkit.EOF:
-			symb = "_EOF"
-		case textkit.EOL:
-			symb = "_EOL"
-		case textkit.Word:
-			if _, ok := keywords[string(token.Form)]; ok {
-				symb = "&" + string(token.Form)
-			} else {
-				symb = "_ID"
-			}
-		}
+		symb := symbolFor(token, keywords)
 		currentState := stateStack[len(stateStack)-1]
-		action := gr.actionTable[tableKey{currentState, symb}]
-		switch action := action.(type) {
+		act := gr.actionTable[tableKey{currentState, symb}]
+		switch act := act.(type) {
 		case *shiftAction:
 			resultStack = append(resultStack, token)
-			stateStack = append(stateStack, action.state)
+			stateStack = append(stateStack, act.state)
 			tokens = tokens[1:]
-			//fmt.Println("SHIFT", currentState, "/", symb, "=>", action.state)
+			//fmt.Println("SHIFT", currentState, "/", symb, "=>", act.state)
 		case *reduceAction:
-			rule := gr.Rules[action.rule]
+			rule := gr.Rules[act.rule]
 			results := resultStack[len(resultStack)-len(rule.RHS):]
 			resultStack = resultStack[: len(resultStack)-len(rule.RHS) : len(resultStack)-len(rule.RHS)]
 			stateStack = stateStack[:len(stateStack)-len(rule.RHS)]
 			r := rule.Conv(results)
-			if r, ok := r.(Located); ok {
-				var (
-					loc textkit.Location
-					set bool
-				)
-				for _, el := range results {
-					switch x := el.(type) {
-					case *textkit.Token:
-						loc = x.Loc
-						set = true
-						goto setloc
-					case Located:
-						loc = x.Location()
-						set = true
-						goto setloc
-					}
-				}
-			setloc:
-				if set {
-					r.SetLocation(loc)
-				}
-			}
+			applyLocation(r, results)
 			resultStack = append(resultStack, r)
 			if nextState, ok := gr.gotoTable[tableKey{stateStack[len(stateStack)-1], rule.LHS}]; ok {
 				//fmt.Println("REDUCE", len(stateStack), len(results), currentState, "/", symb, "=>", nextState)
 				stateStack = append(stateStack, nextState.(*gotoAction).state)
 			} else {
-				panic("can't reduce")
+				errs = append(errs, &ParseError{State: stateStack[len(stateStack)-1], Token: token})
+				return nil, errs
 			}
 		case *acceptAction:
 			//fmt.Println("ACCEPT", len(stateStack), len(resultStack))
+			if len(errs) > 0 {
+				return resultStack[0], errs
+			}
 			return resultStack[0], nil
 		default:
-			var expected []string
-			for terminal := range terminals {
-				if _, ok := gr.actionTable[tableKey{currentState, terminal}]; ok {
-					symbol := terminal
-					if terminal[0] == '&' {
-						symbol = "'" + terminal[1:] + "'"
-					}
-					if terminal == "_ID" {
-						symbol = "identifier"
-					}
-					if terminal == "_STR" {
-						symbol = "string"
-					}
-					if terminal == "_NUM" {
-						symbol = "number"
-					}
-					if terminal == "_EOF" {
-						symbol = "EOF"
-					}
-					if terminal == "_EOL" {
-						symbol = "EOL"
-					}
-					expected = append(expected, symbol)
-				}
-			}
-			if len(expected) > 1 {
-				return nil, fmt.Errorf("expected one of %s at line %s", strings.Join(expected, ", "), token.Loc)
-			} else if len(expected) > 0 {
-				return nil, fmt.Errorf("expected %s at line %s", expected[0], token.Loc)
-			} else {
-				return nil, fmt.Errorf("no expected symbol")
+			expected := gr.expectedSymbols(currentState, terminals)
+			errs = append(errs, &ParseError{State: currentState, Token: token, Expected: expected})
+			recovery := RecoveryAction{Kind: RecoverySkip}
+			if gr.ErrorHandler != nil {
+				recovery = gr.ErrorHandler(currentState, token, expected)
 			}
-			/*for terminal, _ := range terminals {
-				if _, ok := gr.actionTable[tableKey{currentState, terminal}]; ok {
-					expected = append(expected, terminal)
+			switch recovery.Kind {
+			case RecoveryAbort:
+				return nil, errs
+			case RecoveryInsert:
+				tokens = append([]*textkit.Token{syntheticToken(recovery.Symbol, token.Loc)}, tokens...)
+			case RecoveryReplace:
+				tokens = append([]*textkit.Token{syntheticToken(recovery.Symbol, token.Loc)}, tokens[1:]...)
+			default: // RecoverySkip
+				if !gr.recover(&stateStack, &resultStack, &tokens, keywords) {
+					return nil, errs
 				}
 			}
-			return nil, fmt.Errorf("expected '%s' at line %d", strings.Join(expected, "|"), token.Line)*/
 		}
 	}
 }
@@ -0,0 +1,339 @@
+// Copyright 2018-2020 Petr Homola. All rights reserved.
+// Use of this source code is governed by the AGPL v3.0
+// that can be found in the LICENSE file.
+
+package lrparser
+
+import (
+	"testing"
+
+	"github.com/phomola/textkit"
+)
+
+var loc = textkit.Location{}
+
+func numTok(form string) *textkit.Token {
+	return &textkit.Token{Type: textkit.Number, Form: []rune(form), Loc: loc}
+}
+
+func symTok(form string) *textkit.Token {
+	return &textkit.Token{Type: textkit.Symbol, Form: []rune(form), Loc: loc}
+}
+
+func eofTok() *textkit.Token {
+	return &textkit.Token{Type: textkit.EOF, Loc: loc}
+}
+
+// TestReduceReduceDeterministic builds a grammar with a genuine
+// reduce/reduce conflict (A -> "_NUM" and B -> "_NUM" both reducible at
+// the same lookahead) and checks that the earliest-declared rule always
+// wins, across many rebuilds - guarding against the conflict resolution
+// depending on map iteration order. It also checks that the reported
+// Conflict always names the same winner/loser as the action table ended
+// up with, regardless of which of the two items BuildItems visited first.
+func TestReduceReduceDeterministic(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		rules := []*Rule{
+			{LHS: "S", RHS: []string{"E"}, Conv: func(a []interface{}) interface{} { return a[0] }},
+			{LHS: "E", RHS: []string{"A"}, Conv: func(a []interface{}) interface{} { return a[0] }},
+			{LHS: "E", RHS: []string{"B"}, Conv: func(a []interface{}) interface{} { return a[0] }},
+			{LHS: "A", RHS: []string{"_NUM"}, Conv: func(a []interface{}) interface{} { return "A" }},
+			{LHS: "B", RHS: []string{"_NUM"}, Conv: func(a []interface{}) interface{} { return "B" }},
+		}
+		gr := NewGrammar(rules)
+		r, err := gr.Parse([]*textkit.Token{numTok("1"), eofTok()})
+		if err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+		if r != "A" {
+			t.Fatalf("expected the earliest-declared rule (A) to win a reduce/reduce conflict, got %v", r)
+		}
+
+		var rrConflict *Conflict
+		for _, c := range gr.Conflicts() {
+			if c.Type == ReduceReduceConflict {
+				c := c
+				rrConflict = &c
+				break
+			}
+		}
+		if rrConflict == nil {
+			t.Fatalf("expected a reduce/reduce conflict to be reported")
+		}
+		// A (rule 3) must be the reported winner: it's the earliest-declared
+		// rule and the one Parse actually used above.
+		if rrConflict.Rule != 3 || rrConflict.OtherRule != 4 {
+			t.Fatalf("expected Conflict{Rule: 3, OtherRule: 4} (A beating B), got Conflict{Rule: %d, OtherRule: %d}", rrConflict.Rule, rrConflict.OtherRule)
+		}
+	}
+}
+
+// TestPrecedenceResolution checks that Grammar.Precedence resolves an
+// ambiguous expression grammar's shift/reduce conflicts the way yacc's
+// %left declarations would: later (higher-priority) operators bind
+// tighter.
+func TestPrecedenceResolution(t *testing.T) {
+	rules := []*Rule{
+		{LHS: "S", RHS: []string{"E"}, Conv: func(a []interface{}) interface{} { return a[0] }},
+		{LHS: "E", RHS: []string{"E", "&+", "E"}, Conv: func(a []interface{}) interface{} { return a[0].(int) + a[2].(int) }},
+		{LHS: "E", RHS: []string{"E", "&*", "E"}, Conv: func(a []interface{}) interface{} { return a[0].(int) * a[2].(int) }},
+		{LHS: "E", RHS: []string{"_NUM"}, Conv: func(a []interface{}) interface{} {
+			switch string(a[0].(*textkit.Token).Form) {
+			case "2":
+				return 2
+			case "3":
+				return 3
+			case "4":
+				return 4
+			}
+			return 0
+		}},
+	}
+	gr := &Grammar{Rules: rules, Precedence: []PrecLevel{
+		{Assoc: LeftAssoc, Terminals: []string{"&+"}},
+		{Assoc: LeftAssoc, Terminals: []string{"&*"}},
+	}}
+	gr.BuildItems()
+	if conflicts := gr.Conflicts(); len(conflicts) != 0 {
+		t.Fatalf("expected the declared precedence to resolve every shift/reduce conflict, got %v", conflicts)
+	}
+	tokens := []*textkit.Token{numTok("2"), symTok("+"), numTok("3"), symTok("*"), numTok("4"), eofTok()}
+	r, err := gr.Parse(tokens)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if r != 2+3*4 {
+		t.Fatalf("expected '*' to bind tighter than '+' (2+3*4=%d), got %v", 2+3*4, r)
+	}
+}
+
+// TestRulePrecTag checks the %prec-equivalent override: a unary minus
+// rule tagged with a higher-than-"+" Prec binds tighter than "+". Its
+// rightmost terminal ("-" itself) has no declared precedence here, so
+// without the tag the conflict would stay unresolved and default to
+// shifting, parsing -2+3 as -(2+3).
+func TestRulePrecTag(t *testing.T) {
+	rules := []*Rule{
+		{LHS: "S", RHS: []string{"E"}, Conv: func(a []interface{}) interface{} { return a[0] }},
+		{LHS: "E", RHS: []string{"E", "&+", "E"}, Conv: func(a []interface{}) interface{} { return a[0].(int) + a[2].(int) }},
+		{LHS: "E", RHS: []string{"&-", "E"}, Prec: "UMINUS", Conv: func(a []interface{}) interface{} { return -a[1].(int) }},
+		{LHS: "E", RHS: []string{"_NUM"}, Conv: func(a []interface{}) interface{} {
+			switch string(a[0].(*textkit.Token).Form) {
+			case "2":
+				return 2
+			case "3":
+				return 3
+			}
+			return 0
+		}},
+	}
+	gr := &Grammar{Rules: rules, Precedence: []PrecLevel{
+		{Assoc: LeftAssoc, Terminals: []string{"&+"}},
+		{Assoc: LeftAssoc, Terminals: []string{"UMINUS"}},
+	}}
+	gr.BuildItems()
+	if conflicts := gr.Conflicts(); len(conflicts) != 0 {
+		t.Fatalf("expected Rule.Prec to resolve every shift/reduce conflict, got %v", conflicts)
+	}
+	tokens := []*textkit.Token{symTok("-"), numTok("2"), symTok("+"), numTok("3"), eofTok()}
+	r, err := gr.Parse(tokens)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if r != -2+3 {
+		t.Fatalf("expected unary '-' (via Rule.Prec \"UMINUS\") to bind tighter than '+' (-2+3=%d), got %v", -2+3, r)
+	}
+}
+
+// TestPanicModeRecovery checks that an "error"-production lets Parse
+// skip a malformed statement and keep going instead of aborting, per
+// ErrorHandler's panic-mode fallback.
+func TestPanicModeRecovery(t *testing.T) {
+	rules := []*Rule{
+		{LHS: "Program", RHS: []string{"StmtList"}, Conv: func(a []interface{}) interface{} { return a[0] }},
+		{LHS: "StmtList", RHS: []string{"StmtList", "Stmt"}, Conv: func(a []interface{}) interface{} {
+			return append(a[0].([]interface{}), a[1])
+		}},
+		{LHS: "StmtList", RHS: []string{"Stmt"}, Conv: func(a []interface{}) interface{} { return []interface{}{a[0]} }},
+		{LHS: "Stmt", RHS: []string{"_NUM", "&;"}, Conv: func(a []interface{}) interface{} { return a[0] }},
+		{LHS: "Stmt", RHS: []string{"error", "&;"}, Conv: func(a []interface{}) interface{} { return nil }},
+	}
+	gr := NewGrammar(rules)
+	tokens := []*textkit.Token{
+		numTok("1"), symTok(";"),
+		symTok("@"), symTok("@"), symTok(";"), // malformed statement, recovered at ';'
+		numTok("2"), symTok(";"),
+		eofTok(),
+	}
+	r, err := gr.Parse(tokens)
+	if err == nil {
+		t.Fatal("expected Parse to report the malformed statement as an error")
+	}
+	perrs, ok := err.(ParseErrors)
+	if !ok || len(perrs) != 1 {
+		t.Fatalf("expected exactly one recovered error, got %v", err)
+	}
+	// "1 ;" is still unreduced when "@" is hit, so recovery pops it on
+	// the way back to the initial state: the result holds the error
+	// statement (nil) and "2 ;".
+	stmts, ok := r.([]interface{})
+	if !ok || len(stmts) != 2 {
+		t.Fatalf("expected the recovered error statement and the statement after it, got %v", r)
+	}
+}
+
+// TestParseGLR checks that an ambiguous grammar (no precedence to
+// disambiguate it) parses to every legal grouping instead of just the
+// one a plain LALR table would have defaulted to.
+func TestParseGLR(t *testing.T) {
+	rules := []*Rule{
+		{LHS: "S", RHS: []string{"E"}, Conv: func(a []interface{}) interface{} { return a[0] }},
+		{LHS: "E", RHS: []string{"E", "&-", "E"}, Conv: func(a []interface{}) interface{} { return a[0].(int) - a[2].(int) }},
+		{LHS: "E", RHS: []string{"_NUM"}, Conv: func(a []interface{}) interface{} {
+			switch string(a[0].(*textkit.Token).Form) {
+			case "9":
+				return 9
+			case "4":
+				return 4
+			case "3":
+				return 3
+			}
+			return 0
+		}},
+	}
+	gr := NewGrammar(rules)
+	tokens := []*textkit.Token{numTok("9"), symTok("-"), numTok("4"), symTok("-"), numTok("3"), eofTok()}
+	results, err := gr.ParseGLR(tokens)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	got := map[int]bool{}
+	for _, r := range results {
+		got[r.(int)] = true
+	}
+	want := map[int]bool{(9 - 4) - 3: true, 9 - (4 - 3): true}
+	if len(got) != len(want) || !got[(9-4)-3] || !got[9-(4-3)] {
+		t.Fatalf("expected both groupings %v, got %v", want, got)
+	}
+}
+
+// TestParseGLRReduceReduceBothBranches builds a grammar with a genuine
+// reduce/reduce conflict (E -> A | E -> B, both reducing "_NUM") and
+// checks that ParseGLR always surfaces both derivations, across many
+// rebuilds. This guards against conflictAlternatives() forking on
+// Conflict.OtherRule when it doesn't actually name the rule that lost
+// the slot in actionTable (see TestReduceReduceDeterministic).
+func TestParseGLRReduceReduceBothBranches(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		rules := []*Rule{
+			{LHS: "S", RHS: []string{"E"}, Conv: func(a []interface{}) interface{} { return a[0] }},
+			{LHS: "E", RHS: []string{"A"}, Conv: func(a []interface{}) interface{} { return a[0] }},
+			{LHS: "E", RHS: []string{"B"}, Conv: func(a []interface{}) interface{} { return a[0] }},
+			{LHS: "A", RHS: []string{"_NUM"}, Conv: func(a []interface{}) interface{} { return "A" }},
+			{LHS: "B", RHS: []string{"_NUM"}, Conv: func(a []interface{}) interface{} { return "B" }},
+		}
+		gr := NewGrammar(rules)
+		results, err := gr.ParseGLR([]*textkit.Token{numTok("1"), eofTok()})
+		if err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+		got := map[string]bool{}
+		for _, r := range results {
+			got[r.(string)] = true
+		}
+		if len(got) != 2 || !got["A"] || !got["B"] {
+			t.Fatalf("expected both derivations {A, B}, got %v (run %d)", results, i)
+		}
+	}
+}
+
+// TestTemplateInstantiation checks that a parameterized template
+// (list(Elem, Sep)) expands and parses like a hand-written list rule.
+func TestTemplateInstantiation(t *testing.T) {
+	rules, err := BuildRules([]*SynSem{
+		{Syn: `list(Elem, Sep) -> Elem`, Sem: func(a []any) any { return []any{a[0]} }},
+		{Syn: `list(Elem, Sep) -> list(Elem, Sep) Sep Elem`, Sem: func(a []any) any {
+			return append(a[0].([]any), a[2])
+		}},
+		{Syn: `Program -> list(_NUM, ",")`, Sem: func(a []any) any { return a[0] }},
+	})
+	if err != nil {
+		t.Fatalf("BuildRules: %v", err)
+	}
+	gr := NewGrammar(rules)
+	tokens := []*textkit.Token{numTok("1"), symTok(","), numTok("2"), symTok(","), numTok("3"), eofTok()}
+	r, err := gr.Parse(tokens)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if els, ok := r.([]any); !ok || len(els) != 3 {
+		t.Fatalf("expected a 3-element list, got %v", r)
+	}
+}
+
+// TestAnonymousGroupAfterNonterminal guards against the template-call
+// disambiguation regressing: a nonterminal immediately followed by a
+// parenthesised group (with whitespace between them discarded by the
+// lexer) must hoist the group, not be misread as a template call.
+func TestAnonymousGroupAfterNonterminal(t *testing.T) {
+	rules, err := BuildRules([]*SynSem{
+		{Syn: `Program -> "if" Expr ("then"|"do") Block`, Sem: func(a []any) any { return a[3] }},
+		{Syn: `Expr -> _NUM`, Sem: func(a []any) any { return a[0] }},
+		{Syn: `Block -> _NUM`, Sem: func(a []any) any { return a[0] }},
+	})
+	if err != nil {
+		t.Fatalf("BuildRules: %v", err)
+	}
+	gr := NewGrammar(rules)
+	for _, kw := range []string{"then", "do"} {
+		tokens := []*textkit.Token{{Type: textkit.Word, Form: []rune("if"), Loc: loc}, numTok("1"),
+			{Type: textkit.Word, Form: []rune(kw), Loc: loc}, numTok("2"), eofTok()}
+		if _, err := gr.Parse(tokens); err != nil {
+			t.Fatalf("parse error with %q branch: %v", kw, err)
+		}
+	}
+}
+
+// TestIncrementalParser checks the REPL/editor-style piecewise API: a
+// caller can Feed partial input, ask NeedsMore whether to read more,
+// Checkpoint a known-good state, and Restore it after an abandoned
+// partial statement.
+func TestIncrementalParser(t *testing.T) {
+	rules := []*Rule{
+		{LHS: "Program", RHS: []string{"StmtList"}, Conv: func(a []interface{}) interface{} { return a[0] }},
+		{LHS: "StmtList", RHS: []string{"StmtList", "Stmt"}, Conv: func(a []interface{}) interface{} {
+			return append(a[0].([]interface{}), a[1])
+		}},
+		{LHS: "StmtList", RHS: []string{"Stmt"}, Conv: func(a []interface{}) interface{} { return []interface{}{a[0]} }},
+		{LHS: "Stmt", RHS: []string{"_NUM", "&;"}, Conv: func(a []interface{}) interface{} { return a[0] }},
+	}
+	gr := NewGrammar(rules)
+	p := gr.NewIncremental()
+
+	if err := p.Feed([]*textkit.Token{numTok("5"), symTok(";")}); err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+	if p.NeedsMore() {
+		t.Fatal("expected a complete statement to not need more input")
+	}
+	cp := p.Checkpoint()
+
+	if err := p.Feed([]*textkit.Token{numTok("6")}); err != nil {
+		t.Fatalf("Feed: %v", err)
+	}
+	if !p.NeedsMore() {
+		t.Fatal("expected a dangling statement (missing ';') to need more input")
+	}
+
+	p.Restore(cp)
+	if p.NeedsMore() {
+		t.Fatal("expected Restore to roll back to the complete checkpoint")
+	}
+	r, err := p.Finish()
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if stmts, ok := r.([]interface{}); !ok || len(stmts) != 1 {
+		t.Fatalf("expected the restored parse to have a single statement, got %v", r)
+	}
+}
@@ -0,0 +1,387 @@
+// Copyright 2018-2020 Petr Homola. All rights reserved.
+// Use of this source code is governed by the AGPL v3.0
+// that can be found in the LICENSE file.
+
+package lrparser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+func isSynIdentRune(c rune) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+type rdKind int
+
+const (
+	rdIdent rdKind = iota
+	rdString
+	rdLParen
+	rdRParen
+	rdComma
+	rdPipe
+)
+
+type rdTok struct {
+	kind rdKind
+	val  string
+}
+
+// lexRD tokenises the RHS of a SynSem.Syn string.
+func lexRD(src string) ([]rdTok, error) {
+	r := []rune(src)
+	var toks []rdTok
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(r) && r[j] != '"' {
+				j++
+			}
+			if j >= len(r) {
+				return nil, fmt.Errorf("synsem: unterminated string literal in %q", src)
+			}
+			toks = append(toks, rdTok{rdString, string(r[i+1 : j])})
+			i = j + 1
+		case c == '(':
+			toks = append(toks, rdTok{rdLParen, "("})
+			i++
+		case c == ')':
+			toks = append(toks, rdTok{rdRParen, ")"})
+			i++
+		case c == ',':
+			toks = append(toks, rdTok{rdComma, ","})
+			i++
+		case c == '|':
+			toks = append(toks, rdTok{rdPipe, "|"})
+			i++
+		case isSynIdentRune(c):
+			j := i
+			for j < len(r) && isSynIdentRune(r[j]) {
+				j++
+			}
+			toks = append(toks, rdTok{rdIdent, string(r[i:j])})
+			i = j
+		default:
+			return nil, fmt.Errorf("synsem: unexpected character %q in %q", c, src)
+		}
+	}
+	return toks, nil
+}
+
+// splitRule splits a SynSem.Syn string into its LHS and RHS halves.
+func splitRule(syn string) (string, string, error) {
+	idx := strings.Index(syn, "->")
+	if idx < 0 {
+		return "", "", fmt.Errorf("synsem: missing '->' in rule %q", syn)
+	}
+	return strings.TrimSpace(syn[:idx]), strings.TrimSpace(syn[idx+2:]), nil
+}
+
+// parseLHS splits a LHS into its name and, if it has the parameterized
+// form `name(p1, p2)`, its formal parameters.
+func parseLHS(lhsText string) (name string, params []string, isTemplate bool) {
+	open := strings.IndexByte(lhsText, '(')
+	if open < 0 {
+		return strings.TrimSpace(lhsText), nil, false
+	}
+	name = strings.TrimSpace(lhsText[:open])
+	inner := strings.TrimSuffix(strings.TrimSpace(lhsText[open+1:]), ")")
+	for _, p := range strings.Split(inner, ",") {
+		params = append(params, strings.TrimSpace(p))
+	}
+	return name, params, true
+}
+
+// ruleTemplate is a parameterized nonterminal schema, declared by one or
+// more SynSem entries whose LHS is `name(params)` and instantiated by
+// referencing `name(arg, ...)` in some other rule's RHS.
+type ruleTemplate struct {
+	params []string
+	alts   []templateAlt
+}
+
+type templateAlt struct {
+	rhsText string
+	sem     func([]interface{}) interface{}
+}
+
+// RuleBuilder turns a batch of SynSem entries into Rules, expanding
+// parameterized templates and anonymous inline groups as it goes. Use
+// NewRuleBuilder directly (instead of the package-level BuildRules) when
+// templates are defined and instantiated across more than one call.
+type RuleBuilder struct {
+	templates    map[string]*ruleTemplate
+	instantiated map[string]string // "name(arg,...)" -> monomorphized nonterminal name
+	anonCounter  int
+	rules        []*Rule // synthetic rules from template instantiation and group hoisting
+}
+
+// NewRuleBuilder returns an empty RuleBuilder.
+func NewRuleBuilder() *RuleBuilder {
+	return &RuleBuilder{templates: make(map[string]*ruleTemplate), instantiated: make(map[string]string)}
+}
+
+// BuildRules parses list into Rules. Entries whose LHS has the
+// parameterized form `name(params)` register a template alternative
+// instead of producing a rule; every other entry's RHS may reference
+// such a template by name, e.g. `list(Expr, ",")`, and/or an anonymous
+// inline group like `("then"|"do")`.
+func (b *RuleBuilder) BuildRules(list []*SynSem) ([]*Rule, error) {
+	// only synthetic rules generated by this call are returned; earlier
+	// calls already returned theirs
+	synthStart := len(b.rules)
+	var direct []*SynSem
+	for _, el := range list {
+		lhsText, rhsText, err := splitRule(el.Syn)
+		if err != nil {
+			return nil, err
+		}
+		name, params, isTemplate := parseLHS(lhsText)
+		if !isTemplate {
+			direct = append(direct, el)
+			continue
+		}
+		tmpl, ok := b.templates[name]
+		if !ok {
+			tmpl = &ruleTemplate{params: params}
+			b.templates[name] = tmpl
+		}
+		tmpl.alts = append(tmpl.alts, templateAlt{rhsText: rhsText, sem: el.Sem})
+	}
+
+	rules := make([]*Rule, 0, len(direct))
+	for _, el := range direct {
+		lhsText, rhsText, _ := splitRule(el.Syn)
+		name, _, _ := parseLHS(lhsText)
+		toks, err := lexRD(rhsText)
+		if err != nil {
+			return nil, err
+		}
+		symbols, err := b.resolveRHS(toks)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, &Rule{LHS: name, RHS: symbols, Conv: el.Sem})
+	}
+
+	result := make([]*Rule, 0, len(rules)+len(b.rules)-synthStart)
+	result = append(result, rules...)
+	result = append(result, b.rules[synthStart:]...)
+	return result, nil
+}
+
+// BuildRule parses a single SynSem entry into a Rule. It's a thin
+// wrapper around RuleBuilder for one-off rules; to define a template in
+// one entry and reference it in another, use RuleBuilder (or
+// BuildRules) so both entries share the same builder.
+func BuildRule(syn string, sem func([]interface{}) interface{}) (*Rule, error) {
+	rules, err := NewRuleBuilder().BuildRules([]*SynSem{{Syn: syn, Sem: sem}})
+	if err != nil {
+		return nil, err
+	}
+	return rules[0], nil
+}
+
+// resolveRHS turns a tokenised RHS into RHS symbols: quoted tokens
+// become keyword/symbol terminals, bare identifiers are kept as written
+// (a nonterminal reference, a `_`-prefixed built-in terminal such as
+// _NUM, or the `error` pseudo-terminal), `name(arg, ...)`
+// instantiates a template, and a parenthesised alternation is hoisted
+// into a synthetic nonterminal.
+func (b *RuleBuilder) resolveRHS(toks []rdTok) ([]string, error) {
+	var symbols []string
+	for i := 0; i < len(toks); {
+		t := toks[i]
+		switch t.kind {
+		case rdString:
+			symbols = append(symbols, "&"+t.val)
+			i++
+		case rdIdent:
+			if _, isTemplate := b.templates[t.val]; isTemplate && i+1 < len(toks) && toks[i+1].kind == rdLParen {
+				args, consumed, err := parseCallArgs(toks[i+1:])
+				if err != nil {
+					return nil, err
+				}
+				sym, err := b.instantiate(t.val, args)
+				if err != nil {
+					return nil, err
+				}
+				symbols = append(symbols, sym)
+				i += 1 + consumed
+			} else {
+				symbols = append(symbols, t.val)
+				i++
+			}
+		case rdLParen:
+			alts, consumed, err := parseGroup(toks[i:])
+			if err != nil {
+				return nil, err
+			}
+			symbols = append(symbols, b.hoistGroup(alts))
+			i += consumed
+		default:
+			return nil, fmt.Errorf("synsem: unexpected token %q", t.val)
+		}
+	}
+	return symbols, nil
+}
+
+// parseCallArgs parses the argument list of a `name(arg, ...)`
+// instantiation; toks[0] must be the opening '('. It returns the raw
+// source text of each argument (so it can be substituted back into a
+// template body) and how many tokens it consumed, including the ')'.
+func parseCallArgs(toks []rdTok) ([]string, int, error) {
+	i := 1
+	var args []string
+	for i < len(toks) && toks[i].kind != rdRParen {
+		switch toks[i].kind {
+		case rdString:
+			args = append(args, `"`+toks[i].val+`"`)
+		case rdIdent:
+			args = append(args, toks[i].val)
+		default:
+			return nil, 0, fmt.Errorf("synsem: unsupported template argument %q", toks[i].val)
+		}
+		i++
+		if i < len(toks) && toks[i].kind == rdComma {
+			i++
+		}
+	}
+	if i >= len(toks) {
+		return nil, 0, fmt.Errorf("synsem: unterminated template instantiation")
+	}
+	return args, i + 1, nil
+}
+
+// parseGroup parses a parenthesised alternation like ("then"|"do");
+// toks[0] must be the opening '('. It returns each alternative as a
+// sequence of RHS symbols and how many tokens it consumed, including
+// the ')'.
+func parseGroup(toks []rdTok) ([][]string, int, error) {
+	i := 1
+	var alts [][]string
+	var cur []string
+	for i < len(toks) {
+		switch toks[i].kind {
+		case rdRParen:
+			alts = append(alts, cur)
+			return alts, i + 1, nil
+		case rdPipe:
+			alts = append(alts, cur)
+			cur = nil
+			i++
+		case rdString:
+			cur = append(cur, "&"+toks[i].val)
+			i++
+		case rdIdent:
+			cur = append(cur, toks[i].val)
+			i++
+		default:
+			return nil, 0, fmt.Errorf("synsem: unexpected token in group")
+		}
+	}
+	return nil, 0, fmt.Errorf("synsem: unterminated group")
+}
+
+// hoistGroup installs one rule per alternative under a fresh synthetic
+// nonterminal and returns its name. Since the group always occupies
+// exactly one RHS slot regardless of which alternative matched, the
+// default action just passes that alternative's value through,
+// preserving index-based args[i] access in the rule that referenced it.
+func (b *RuleBuilder) hoistGroup(alts [][]string) string {
+	b.anonCounter++
+	name := fmt.Sprintf("$anon%d", b.anonCounter)
+	for _, rhs := range alts {
+		rhsLen := len(rhs)
+		b.rules = append(b.rules, &Rule{
+			LHS: name,
+			RHS: rhs,
+			Conv: func(args []interface{}) interface{} {
+				if rhsLen == 1 {
+					return args[0]
+				}
+				return args
+			},
+		})
+	}
+	return name
+}
+
+// literalNames gives ASCII names to common punctuation, for naming the
+// monomorphized nonterminal of a template instantiated with a literal
+// argument (list(Expr, ",") -> list_Expr__comma).
+var literalNames = map[string]string{
+	",": "comma", ";": "semi", ":": "colon", "+": "plus", "-": "minus",
+	"*": "star", "/": "slash", "(": "lparen", ")": "rparen",
+	"[": "lbrack", "]": "rbrack", "{": "lbrace", "}": "rbrace",
+	"=": "eq", "<": "lt", ">": "gt", ".": "dot",
+}
+
+func literalName(lit string) string {
+	if n, ok := literalNames[lit]; ok {
+		return n
+	}
+	return lit
+}
+
+func mangleName(name string, rawArgs []string) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+	for _, a := range rawArgs {
+		if strings.HasPrefix(a, `"`) {
+			sb.WriteString("__")
+			sb.WriteString(literalName(strings.Trim(a, `"`)))
+		} else {
+			sb.WriteString("_")
+			sb.WriteString(a)
+		}
+	}
+	return sb.String()
+}
+
+func substituteWord(text, word, repl string) string {
+	return regexp.MustCompile(`\b`+regexp.QuoteMeta(word)+`\b`).ReplaceAllString(text, repl)
+}
+
+// instantiate monomorphizes template name for rawArgs, generating its
+// rules on first use (reserving the synthetic name before expanding the
+// body, so a template that recurses on itself - as list(X, sep) does -
+// resolves its own reference to the same nonterminal instead of looping).
+func (b *RuleBuilder) instantiate(name string, rawArgs []string) (string, error) {
+	tmpl, ok := b.templates[name]
+	if !ok {
+		return "", fmt.Errorf("synsem: undefined template %q", name)
+	}
+	if len(rawArgs) != len(tmpl.params) {
+		return "", fmt.Errorf("synsem: template %q expects %d argument(s), got %d", name, len(tmpl.params), len(rawArgs))
+	}
+	key := name + "(" + strings.Join(rawArgs, ",") + ")"
+	if synth, ok := b.instantiated[key]; ok {
+		return synth, nil
+	}
+	synth := mangleName(name, rawArgs)
+	b.instantiated[key] = synth
+	for _, alt := range tmpl.alts {
+		text := alt.rhsText
+		for i, p := range tmpl.params {
+			text = substituteWord(text, p, rawArgs[i])
+		}
+		toks, err := lexRD(text)
+		if err != nil {
+			return "", err
+		}
+		symbols, err := b.resolveRHS(toks)
+		if err != nil {
+			return "", err
+		}
+		b.rules = append(b.rules, &Rule{LHS: synth, RHS: symbols, Conv: alt.sem})
+	}
+	return synth, nil
+}
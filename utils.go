@@ -53,8 +53,8 @@ func CoalesceSymbols(tokens []*textkit.Token, clusters []string) []*textkit.Toke
 // BuildOptSeq builds an optional sequence.
 func BuildOptSeq(root string, head, tail []string, builder func([]interface{}, []interface{}) interface{}) []*Rule {
 	var rules []*Rule
-	rules = append(rules, &Rule{root, head, func(r []interface{}) interface{} { return builder(r, nil) }})
-	rules = append(rules, &Rule{root, append(head, tail...), func(r []interface{}) interface{} { return builder(r[:len(head)], r[len(head):]) }})
+	rules = append(rules, &Rule{LHS: root, RHS: head, Conv: func(r []interface{}) interface{} { return builder(r, nil) }})
+	rules = append(rules, &Rule{LHS: root, RHS: append(head, tail...), Conv: func(r []interface{}) interface{} { return builder(r[:len(head)], r[len(head):]) }})
 	return rules
 }
 
@@ -71,15 +71,15 @@ func BuildListRules(root, leaf string, canBeEmpty bool, leftBracket, sep, rightB
 	if rightBracket != "" {
 		symbols = append(symbols, rightBracket)
 	}
-	rules = append(rules, &Rule{root, symbols, func(r []interface{}) interface{} { return builder(r[index].([]interface{})) }})
+	rules = append(rules, &Rule{LHS: root, RHS: symbols, Conv: func(r []interface{}) interface{} { return builder(r[index].([]interface{})) }})
 	if canBeEmpty {
-		rules = append(rules, &Rule{root, []string{leftBracket, rightBracket}, func(r []interface{}) interface{} { return builder(nil) }})
+		rules = append(rules, &Rule{LHS: root, RHS: []string{leftBracket, rightBracket}, Conv: func(r []interface{}) interface{} { return builder(nil) }})
 	}
-	rules = append(rules, &Rule{root + "Els", []string{leaf}, func(r []interface{}) interface{} { return []interface{}{r[0]} }})
+	rules = append(rules, &Rule{LHS: root + "Els", RHS: []string{leaf}, Conv: func(r []interface{}) interface{} { return []interface{}{r[0]} }})
 	if sep != "" {
-		rules = append(rules, &Rule{root + "Els", []string{root + "Els", sep, leaf}, func(r []interface{}) interface{} { return append(r[0].([]interface{}), r[2]) }})
+		rules = append(rules, &Rule{LHS: root + "Els", RHS: []string{root + "Els", sep, leaf}, Conv: func(r []interface{}) interface{} { return append(r[0].([]interface{}), r[2]) }})
 	} else {
-		rules = append(rules, &Rule{root + "Els", []string{root + "Els", leaf}, func(r []interface{}) interface{} { return append(r[0].([]interface{}), r[1]) }})
+		rules = append(rules, &Rule{LHS: root + "Els", RHS: []string{root + "Els", leaf}, Conv: func(r []interface{}) interface{} { return append(r[0].([]interface{}), r[1]) }})
 	}
 	return rules
 }
@@ -121,7 +121,7 @@ func BuildOperatorRules(root, leaf string, ops []Operator, builder func(string,
 		prios = append(prios, p)
 	}
 	sort.Slice(prios, func(i, j int) bool { return i < j })
-	rules := []*Rule{&Rule{root, []string{fmt.Sprintf("%sOp%d", root, prios[0])}, func(r []interface{}) interface{} { return r[0] }}}
+	rules := []*Rule{&Rule{LHS: root, RHS: []string{fmt.Sprintf("%sOp%d", root, prios[0])}, Conv: func(r []interface{}) interface{} { return r[0] }}}
 	for i, prio := range prios {
 		sym1 := fmt.Sprintf("%sOp%d", root, prio)
 		var sym2 string
@@ -144,10 +144,10 @@ func BuildOperatorRules(root, leaf string, ops []Operator, builder func(string,
 				symbols = append(symbols, sym2)
 			}
 			rules2 := []*Rule{
-				&Rule{sym1, symbols, func(r []interface{}) interface{} {
+				&Rule{LHS: sym1, RHS: symbols, Conv: func(r []interface{}) interface{} {
 					return builder(op.Name(), r[0], r[len(r)-1])
 				}},
-				&Rule{sym1, []string{sym2}, func(r []interface{}) interface{} { return r[0] }},
+				&Rule{LHS: sym1, RHS: []string{sym2}, Conv: func(r []interface{}) interface{} { return r[0] }},
 			}
 			rules = append(rules, rules2...)
 		}
@@ -161,17 +161,13 @@ type SynSem struct {
 	Sem func([]any) any
 }
 
-// BuildRules creates rules from a slice of `SynSem`s.
+// BuildRules creates rules from a slice of `SynSem`s. Entries whose LHS
+// has the parameterized form `name(params)` (see RuleBuilder) define a
+// reusable rule template instead of a rule; the rest may reference such
+// a template, or an anonymous inline group like `("then"|"do")`,
+// anywhere in their RHS.
 func BuildRules(list []*SynSem) ([]*Rule, error) {
-	rules := make([]*Rule, len(list))
-	for i, el := range list {
-		r, err := BuildRule(el.Syn, el.Sem)
-		if err != nil {
-			return nil, err
-		}
-		rules[i] = r
-	}
-	return rules, nil
+	return NewRuleBuilder().BuildRules(list)
 }
 
 // MustBuildRules creates rules from a slice of `SynSem`s. It panics on error.